@@ -0,0 +1,335 @@
+package cluster
+
+import (
+	"container/list"
+	"encoding/gob"
+	"os"
+	"parser"
+	"path/filepath"
+	p "protocol"
+	"strings"
+	"sync"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+const (
+	defaultCardinalityCacheSize = 10000
+	maxObservedCardinality      = 100000
+	cardinalityEstimatesFile    = "cardinality_estimates.gob"
+	cardinalityPersistInterval  = 30 * time.Second
+
+	// maxEstimatedBufferSize caps tickCount * cardinality so one
+	// high-cardinality group-by query can't request a response channel
+	// with an unreasonable number of slots.
+	maxEstimatedBufferSize = 100000
+)
+
+// WALDirectory is implemented by WAL implementations that persist to a
+// directory on disk. When the shard's WAL implements it, the cardinality
+// estimator saves its state alongside the WAL so cold starts after a
+// restart still get a reasonable buffer size after one warm-up query.
+type WALDirectory interface {
+	Directory() string
+}
+
+type cardinalityEntry struct {
+	Key         string
+	Cardinality int
+}
+
+// CardinalityEstimator keeps a rolling estimate of distinct group-by
+// cardinality per (database, series, groupByColumns), used to size a
+// query's response buffer instead of guessing from shard duration alone.
+type CardinalityEstimator struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List // most-recently-used at the front
+	path     string
+	dirty    bool
+	stop     chan struct{}
+}
+
+func NewCardinalityEstimator(wal WAL) *CardinalityEstimator {
+	estimator := &CardinalityEstimator{
+		capacity: defaultCardinalityCacheSize,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		stop:     make(chan struct{}),
+	}
+	if dir, ok := wal.(WALDirectory); ok {
+		estimator.path = filepath.Join(dir.Directory(), cardinalityEstimatesFile)
+		estimator.load()
+		go estimator.persistPeriodically()
+	}
+	return estimator
+}
+
+// queryCacheDimensions derives the (series, groupByColumns) part of the
+// cache key from a query string by stripping the WHERE clause, which is
+// where time bounds and other per-invocation predicates live. Without this,
+// the same recurring query would get a new cache key on every call since
+// its time range keeps moving.
+func queryCacheDimensions(queryString string) (series string, groupByColumns []string) {
+	lower := strings.ToLower(queryString)
+	series = queryString
+
+	if idx := strings.Index(lower, " group by "); idx >= 0 {
+		series = queryString[:idx]
+		groupByClause := queryString[idx+len(" group by "):]
+		if w := strings.Index(strings.ToLower(groupByClause), " where "); w >= 0 {
+			groupByClause = groupByClause[:w]
+		}
+		for _, column := range strings.Split(groupByClause, ",") {
+			if column = strings.TrimSpace(column); column != "" {
+				groupByColumns = append(groupByColumns, column)
+			}
+		}
+	}
+
+	if idx := strings.Index(strings.ToLower(series), " where "); idx >= 0 {
+		series = series[:idx]
+	}
+	series = strings.TrimSpace(series)
+	return series, groupByColumns
+}
+
+func cardinalityKey(database, series string, groupByColumns []string) string {
+	key := database + "\x00" + series
+	for _, column := range groupByColumns {
+		key += "\x00" + column
+	}
+	return key
+}
+
+// Get returns the last observed cardinality for this dimension, if any.
+func (self *CardinalityEstimator) Get(database, series string, groupByColumns []string) (int, bool) {
+	key := cardinalityKey(database, series, groupByColumns)
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	elem, ok := self.entries[key]
+	if !ok {
+		return 0, false
+	}
+	self.order.MoveToFront(elem)
+	return elem.Value.(*cardinalityEntry).Cardinality, true
+}
+
+// Update records a fresh cardinality observation for this dimension,
+// evicting the least-recently-used entry once the cache is full. The new
+// state is persisted in the background rather than inline, so a query's
+// response time isn't stretched by a disk write on every completion.
+func (self *CardinalityEstimator) Update(database, series string, groupByColumns []string, cardinality int) {
+	key := cardinalityKey(database, series, groupByColumns)
+
+	self.mu.Lock()
+	if elem, ok := self.entries[key]; ok {
+		elem.Value.(*cardinalityEntry).Cardinality = cardinality
+		self.order.MoveToFront(elem)
+	} else {
+		elem := self.order.PushFront(&cardinalityEntry{Key: key, Cardinality: cardinality})
+		self.entries[key] = elem
+		if self.order.Len() > self.capacity {
+			oldest := self.order.Back()
+			self.order.Remove(oldest)
+			delete(self.entries, oldest.Value.(*cardinalityEntry).Key)
+		}
+	}
+	self.dirty = true
+	self.mu.Unlock()
+}
+
+// Stop ends the background persistence loop, flushing one last time first.
+func (self *CardinalityEstimator) Stop() {
+	close(self.stop)
+}
+
+func (self *CardinalityEstimator) persistPeriodically() {
+	ticker := time.NewTicker(cardinalityPersistInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			self.persistIfDirty()
+		case <-self.stop:
+			self.persistIfDirty()
+			return
+		}
+	}
+}
+
+func (self *CardinalityEstimator) persistIfDirty() {
+	self.mu.Lock()
+	if !self.dirty {
+		self.mu.Unlock()
+		return
+	}
+	self.dirty = false
+	entries := make([]*cardinalityEntry, 0, self.order.Len())
+	for elem := self.order.Front(); elem != nil; elem = elem.Next() {
+		entries = append(entries, elem.Value.(*cardinalityEntry))
+	}
+	self.mu.Unlock()
+
+	f, err := os.Create(self.path)
+	if err != nil {
+		log.Warn("Could not persist cardinality estimates to %s: %s", self.path, err)
+		return
+	}
+	defer f.Close()
+	if err := gob.NewEncoder(f).Encode(entries); err != nil {
+		log.Warn("Could not persist cardinality estimates to %s: %s", self.path, err)
+	}
+}
+
+func (self *CardinalityEstimator) load() {
+	f, err := os.Open(self.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var entries []*cardinalityEntry
+	if err := gob.NewDecoder(f).Decode(&entries); err != nil {
+		log.Warn("Could not load cardinality estimates from %s: %s", self.path, err)
+		return
+	}
+	for _, entry := range entries {
+		self.entries[entry.Key] = self.order.PushBack(entry)
+	}
+}
+
+// cardinalityTracker wraps a QueryProcessor to count the distinct series
+// names (each one is a distinct group-by-tag combination) flowing through
+// a query, and feeds that count back into a CardinalityEstimator once the
+// query is done.
+type cardinalityTracker struct {
+	processor      QueryProcessor
+	estimator      *CardinalityEstimator
+	database       string
+	series         string
+	groupByColumns []string
+	seen           map[string]bool
+}
+
+func newCardinalityTracker(processor QueryProcessor, estimator *CardinalityEstimator, querySpec *parser.QuerySpec) *cardinalityTracker {
+	series, groupByColumns := queryCacheDimensions(querySpec.GetQueryString())
+	return &cardinalityTracker{
+		processor:      processor,
+		estimator:      estimator,
+		database:       querySpec.Database(),
+		series:         series,
+		groupByColumns: groupByColumns,
+		seen:           make(map[string]bool),
+	}
+}
+
+func (self *cardinalityTracker) recordSeries(seriesName *string) {
+	if seriesName == nil {
+		return
+	}
+	self.seen[*seriesName] = true
+}
+
+func (self *cardinalityTracker) YieldPoint(seriesName *string, columnNames []string, point *p.Point) bool {
+	self.recordSeries(seriesName)
+	return self.processor.YieldPoint(seriesName, columnNames, point)
+}
+
+func (self *cardinalityTracker) YieldSeries(series *p.Series) bool {
+	self.recordSeries(series.Name)
+	return self.processor.YieldSeries(series)
+}
+
+func (self *cardinalityTracker) Close() {
+	self.processor.Close()
+	self.estimator.Update(self.database, self.series, self.groupByColumns, len(self.seen))
+}
+
+func (self *cardinalityTracker) SetShardInfo(shardId int, shardLocal bool) {
+	self.processor.SetShardInfo(shardId, shardLocal)
+}
+
+func (self *cardinalityTracker) GetName() string {
+	return "CardinalityTracker"
+}
+
+// estimatedBufferSize returns tickCount * the last observed cardinality for
+// querySpec's dimension, capped at maxObservedCardinality, if an estimate
+// is available yet.
+func (self *ShardData) estimatedBufferSize(querySpec *parser.QuerySpec, tickCount int) (int, bool) {
+	if self.cardinalityEstimator == nil || querySpec.GetGroupByColumnCount() == 0 {
+		return 0, false
+	}
+	series, groupByColumns := queryCacheDimensions(querySpec.GetQueryString())
+	cardinality, ok := self.cardinalityEstimator.Get(querySpec.Database(), series, groupByColumns)
+	if !ok {
+		return 0, false
+	}
+	if cardinality > maxObservedCardinality {
+		cardinality = maxObservedCardinality
+	}
+	size := tickCount * cardinality
+	if size > maxEstimatedBufferSize {
+		size = maxEstimatedBufferSize
+	}
+	return size, true
+}
+
+// growableResponseBuffer relays *p.Response values from Send to the
+// channel returned by Out, buffering any that arrive faster than Out's
+// reader can drain them in a plain slice instead of blocking Send on a
+// fixed-size channel. This is the real fallback for a query whose
+// cardinality we have no estimate for yet, replacing a blind fixed-size
+// guess with a buffer that grows as needed.
+type growableResponseBuffer struct {
+	in  chan *p.Response
+	out chan *p.Response
+}
+
+// NewGrowableResponseRelay starts relaying responses sent to the returned
+// buffer's Send method onto out, queueing internally so Send never blocks
+// on out's reader. Call Close once no more responses will be sent.
+func NewGrowableResponseRelay(out chan *p.Response) *growableResponseBuffer {
+	buffer := &growableResponseBuffer{
+		in:  make(chan *p.Response),
+		out: out,
+	}
+	go buffer.run()
+	return buffer
+}
+
+func (self *growableResponseBuffer) Send(res *p.Response) {
+	self.in <- res
+}
+
+func (self *growableResponseBuffer) Close() {
+	close(self.in)
+}
+
+func (self *growableResponseBuffer) run() {
+	var queue []*p.Response
+	in := self.in
+	for in != nil || len(queue) > 0 {
+		if len(queue) == 0 {
+			res, ok := <-in
+			if !ok {
+				return
+			}
+			queue = append(queue, res)
+			continue
+		}
+		select {
+		case res, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			queue = append(queue, res)
+		case self.out <- queue[0]:
+			queue = queue[1:]
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package cluster
+
+import (
+	"fmt"
+	p "protocol"
+)
+
+// BufferWriteWithAck behaves like BufferWrite but returns a channel that
+// receives a single value once the remote datastore has durably applied
+// the request (nil) or failed to do so (an error). It's built on the same
+// request/response plumbing as MakeRequest rather than the fire-and-forget
+// BufferWrite, since we need to learn when the write actually lands.
+// Only used when the caller needs a write consistency level stronger than
+// ConsistencyAny.
+func (self *ClusterServer) BufferWriteWithAck(request *p.Request) <-chan error {
+	ack := make(chan error, 1)
+	responseChan := make(chan *p.Response, 1)
+	go self.MakeRequest(request, responseChan)
+
+	go func() {
+		for res := range responseChan {
+			if res.ErrorMessage != nil {
+				ack <- fmt.Errorf(res.GetErrorMessage())
+				return
+			}
+			if res.Type != nil && *res.Type == endStreamResponse {
+				ack <- nil
+				return
+			}
+		}
+		// responseChan closed without an explicit success signal, e.g. a
+		// dropped connection mid-write. Treat it as a failed ack rather
+		// than silently counting it toward the write's consistency level,
+		// matching how drainReplicaResponse treats the same situation on
+		// the read path.
+		ack <- fmt.Errorf("connection closed before write was acked")
+	}()
+	return ack
+}
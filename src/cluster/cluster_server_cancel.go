@@ -0,0 +1,16 @@
+package cluster
+
+import (
+	p "protocol"
+)
+
+var cancelRequestType = p.Request_CANCEL_REQUEST
+
+// CancelRequest tells this replica to stop processing requestId and
+// release any resources tied to its response stream. Used by hedged reads
+// to clean up the replicas that lost the race to a faster one.
+func (self *ClusterServer) CancelRequest(requestId uint32) {
+	request := &p.Request{Type: &cancelRequestType, Id: &requestId}
+	responseChan := make(chan *p.Response, 1)
+	self.MakeRequest(request, responseChan)
+}
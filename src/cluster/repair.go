@@ -0,0 +1,217 @@
+package cluster
+
+import (
+	"common"
+	"fmt"
+	p "protocol"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// repairBucketDuration is the size of the time window that Repair compares
+// replicas over. Smaller buckets narrow down divergence faster at the cost
+// of more round trips per sweep.
+const repairBucketDuration = time.Hour
+
+var (
+	shardDigestRequest     = p.Request_SHARD_DIGEST
+	shardFetchRangeRequest = p.Request_SHARD_FETCH_RANGE
+	writeRequest           = p.Request_WRITE
+)
+
+// ShardDigest summarizes the points a replica holds for one repair bucket
+// so two replicas can be compared without shipping the raw data.
+type ShardDigest struct {
+	Hash        uint64
+	MaxSequence uint64
+}
+
+// Repair walks this shard's time range in repairBucketDuration buckets and,
+// for any bucket where a replica's digest doesn't match ours, pulls the
+// points from that replica and replays them locally. Every live replica
+// whose digest differs is pulled from in turn, in clusterServers order;
+// replicas are not ranked by their digest's MaxSequence. It's meant to be run in the background on a
+// schedule (see ShardRepairScheduler) or on demand via an admin RPC. It's a
+// no-op for shards that aren't replicated or aren't local, since there's
+// nothing to compare against or repair into.
+func (self *ShardData) Repair(stop <-chan struct{}) error {
+	if !self.IsLocal || len(self.clusterServers) == 0 {
+		return nil
+	}
+
+	for bucketStart := self.startTime; bucketStart.Before(self.endTime); bucketStart = bucketStart.Add(repairBucketDuration) {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		bucketEnd := bucketStart.Add(repairBucketDuration)
+		if bucketEnd.After(self.endTime) {
+			bucketEnd = self.endTime
+		}
+		if err := self.repairBucket(bucketStart, bucketEnd); err != nil {
+			log.Error("Error repairing shard %d bucket [%s, %s): %s", self.id, bucketStart, bucketEnd, err)
+		}
+	}
+	return nil
+}
+
+func (self *ShardData) repairBucket(start, end time.Time) error {
+	shard, err := self.store.GetOrCreateShard(self.id)
+	if err != nil {
+		return err
+	}
+	defer self.store.ReturnShard(self.id)
+
+	local, err := shard.Digest(common.TimeToMicroseconds(start), common.TimeToMicroseconds(end))
+	if err != nil {
+		return err
+	}
+
+	for _, server := range self.clusterServers {
+		if !server.IsUp() {
+			continue
+		}
+		remote, err := self.requestDigest(server, start, end)
+		if err != nil {
+			log.Warn("Could not get repair digest from server %d for shard %d: %s", server.Id, self.id, err)
+			continue
+		}
+		if remote.Hash == local.Hash {
+			continue
+		}
+
+		log.Info("Shard %d bucket [%s, %s) diverged from server %d, repairing", self.id, start, end, server.Id)
+		if err := self.pullAndReplay(server, start, end); err != nil {
+			log.Error("Could not repair shard %d bucket [%s, %s) from server %d: %s", self.id, start, end, server.Id, err)
+			continue
+		}
+		local, err = shard.Digest(common.TimeToMicroseconds(start), common.TimeToMicroseconds(end))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requestDigest asks server for its digest of [start, end) via a
+// Request_SHARD_DIGEST request and decodes the single row it responds with.
+func (self *ShardData) requestDigest(server *ClusterServer, start, end time.Time) (*ShardDigest, error) {
+	startMicros := common.TimeToMicroseconds(start)
+	endMicros := common.TimeToMicroseconds(end)
+	request := &p.Request{
+		Type:            &shardDigestRequest,
+		ShardId:         &self.id,
+		DigestStartTime: &startMicros,
+		DigestEndTime:   &endMicros,
+	}
+
+	responseChan := make(chan *p.Response, 1)
+	go server.MakeRequest(request, responseChan)
+
+	for res := range responseChan {
+		if res.ErrorMessage != nil {
+			return nil, fmt.Errorf(res.GetErrorMessage())
+		}
+		if res.ShardDigestHash != nil && res.ShardDigestMaxSequence != nil {
+			return &ShardDigest{Hash: res.GetShardDigestHash(), MaxSequence: res.GetShardDigestMaxSequence()}, nil
+		}
+		if res.Type != nil && *res.Type == endStreamResponse {
+			break
+		}
+	}
+	return nil, fmt.Errorf("server %d never returned a digest for shard %d", server.Id, self.id)
+}
+
+// pullAndReplay fetches the points server holds for [start, end) and writes
+// them into the local store, converging this replica with the remote one.
+func (self *ShardData) pullAndReplay(server *ClusterServer, start, end time.Time) error {
+	startMicros := common.TimeToMicroseconds(start)
+	endMicros := common.TimeToMicroseconds(end)
+	request := &p.Request{
+		Type:            &shardFetchRangeRequest,
+		ShardId:         &self.id,
+		DigestStartTime: &startMicros,
+		DigestEndTime:   &endMicros,
+	}
+
+	responseChan := make(chan *p.Response, 100)
+	go server.MakeRequest(request, responseChan)
+
+	for res := range responseChan {
+		if res.Type != nil && *res.Type == endStreamResponse {
+			if res.ErrorMessage != nil {
+				return fmt.Errorf(res.GetErrorMessage())
+			}
+			return nil
+		}
+		if res.Series == nil || res.Database == nil {
+			continue
+		}
+		if err := self.store.Write(&p.Request{Type: &writeRequest, Database: res.Database, Series: res.Series, ShardId: &self.id}); err != nil {
+			return err
+		}
+	}
+	// responseChan closed without an end-of-stream frame, e.g. the
+	// connection to server dropped mid-pull. Report it as a failed repair
+	// rather than letting the bucket silently pass as converged.
+	return fmt.Errorf("server %d closed the connection before completing the repair pull for shard %d", server.Id, self.id)
+}
+
+// ShardRepairScheduler walks a set of local shards on a cadence, running
+// Repair on each one. It's also used to service the admin "repair this
+// shard now" RPC by triggering a single shard out of band.
+type ShardRepairScheduler struct {
+	shards   func() []*ShardData
+	interval time.Duration
+	stop     chan struct{}
+}
+
+// NewShardRepairScheduler returns a scheduler that repairs every shard
+// returned by shards (typically the cluster's locally-held shards) once
+// per interval.
+func NewShardRepairScheduler(shards func() []*ShardData, interval time.Duration) *ShardRepairScheduler {
+	return &ShardRepairScheduler{shards: shards, interval: interval, stop: make(chan struct{})}
+}
+
+// Start runs the repair sweep on a ticker until Stop is called.
+func (self *ShardRepairScheduler) Start() {
+	go func() {
+		ticker := time.NewTicker(self.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				self.runSweep()
+			case <-self.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (self *ShardRepairScheduler) Stop() {
+	close(self.stop)
+}
+
+func (self *ShardRepairScheduler) runSweep() {
+	for _, shard := range self.shards() {
+		log.Info("Anti-entropy sweep: repairing shard %d", shard.Id())
+		if err := shard.Repair(self.stop); err != nil {
+			log.Error("Anti-entropy sweep failed for shard %d: %s", shard.Id(), err)
+		}
+	}
+}
+
+// RepairShard triggers an immediate, synchronous repair of a single shard
+// by id, for the admin "repair this shard now" RPC.
+func (self *ShardRepairScheduler) RepairShard(shardId uint32) error {
+	for _, shard := range self.shards() {
+		if shard.Id() == shardId {
+			return shard.Repair(self.stop)
+		}
+	}
+	return fmt.Errorf("no local shard with id %d", shardId)
+}
@@ -0,0 +1,110 @@
+package cluster
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ReplicaSelectionStrategy picks the next server to try out of candidates.
+// Implementations must be safe for concurrent use since a single ShardData
+// is shared across queries.
+type ReplicaSelectionStrategy interface {
+	SelectServer(candidates []*ClusterServer) *ClusterServer
+}
+
+// RandomReplicaSelector preserves the shard's original "pick any healthy
+// server" behavior.
+type RandomReplicaSelector struct{}
+
+func NewRandomReplicaSelector() *RandomReplicaSelector {
+	return &RandomReplicaSelector{}
+}
+
+func (self *RandomReplicaSelector) SelectServer(candidates []*ClusterServer) *ClusterServer {
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[int(time.Now().UnixNano()%int64(len(candidates)))]
+}
+
+// RoundRobinReplicaSelector cycles through candidates in order, keeping its
+// own counter across calls so repeated queries spread across replicas.
+type RoundRobinReplicaSelector struct {
+	mu    sync.Mutex
+	count uint64
+}
+
+func NewRoundRobinReplicaSelector() *RoundRobinReplicaSelector {
+	return &RoundRobinReplicaSelector{}
+}
+
+func (self *RoundRobinReplicaSelector) SelectServer(candidates []*ClusterServer) *ClusterServer {
+	if len(candidates) == 0 {
+		return nil
+	}
+	self.mu.Lock()
+	idx := self.count % uint64(len(candidates))
+	self.count++
+	self.mu.Unlock()
+	return candidates[idx]
+}
+
+// LeastLoadedReplicaSelector tracks an exponentially weighted moving average
+// of query latency per server and picks the lowest one. A candidate with no
+// estimate yet is picked ahead of the measured ones; once every candidate
+// has an estimate, the one with the lowest estimate is always picked.
+type LeastLoadedReplicaSelector struct {
+	mu      sync.Mutex
+	ewma    map[uint32]time.Duration
+	alpha   float64
+	jitterR *rand.Rand
+}
+
+func NewLeastLoadedReplicaSelector() *LeastLoadedReplicaSelector {
+	return &LeastLoadedReplicaSelector{
+		ewma:    make(map[uint32]time.Duration),
+		alpha:   0.2,
+		jitterR: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (self *LeastLoadedReplicaSelector) SelectServer(candidates []*ClusterServer) *ClusterServer {
+	if len(candidates) == 0 {
+		return nil
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	best := candidates[0]
+	bestLatency, ok := self.ewma[best.Id]
+	if !ok {
+		// no data yet for this server, give it a chance
+		return candidates[self.jitterR.Intn(len(candidates))]
+	}
+	for _, candidate := range candidates[1:] {
+		latency, ok := self.ewma[candidate.Id]
+		if !ok {
+			return candidate
+		}
+		if latency < bestLatency {
+			best = candidate
+			bestLatency = latency
+		}
+	}
+	return best
+}
+
+// RecordLatency updates the rolling latency estimate for serverId with the
+// duration of a finished query against that replica. queryWithRetry records
+// only attempts that completed without error; hedged reads record nothing.
+func (self *LeastLoadedReplicaSelector) RecordLatency(serverId uint32, latency time.Duration) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	previous, ok := self.ewma[serverId]
+	if !ok {
+		self.ewma[serverId] = latency
+		return
+	}
+	self.ewma[serverId] = time.Duration(self.alpha*float64(latency) + (1-self.alpha)*float64(previous))
+}
@@ -8,6 +8,7 @@ import (
 	p "protocol"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 	"wal"
 
@@ -59,38 +60,44 @@ const (
 )
 
 type ShardData struct {
-	id              uint32
-	startTime       time.Time
-	startMicro      int64
-	endMicro        int64
-	endTime         time.Time
-	wal             WAL
-	servers         []wal.Server
-	clusterServers  []*ClusterServer
-	store           LocalShardStore
-	serverIds       []uint32
-	shardType       ShardType
-	durationIsSplit bool
-	shardDuration   time.Duration
-	shardSeconds    int64
-	localServerId   uint32
-	IsLocal         bool
+	id                   uint32
+	startTime            time.Time
+	startMicro           int64
+	endMicro             int64
+	endTime              time.Time
+	wal                  WAL
+	servers              []wal.Server
+	clusterServers       []*ClusterServer
+	store                LocalShardStore
+	serverIds            []uint32
+	shardType            ShardType
+	durationIsSplit      bool
+	shardDuration        time.Duration
+	shardSeconds         int64
+	localServerId        uint32
+	IsLocal              bool
+	maxQueryRetries      int
+	replicaSelector      ReplicaSelectionStrategy
+	hedgeReplicaCount    int
+	hedgeDelay           time.Duration
+	cardinalityEstimator *CardinalityEstimator
 }
 
 func NewShard(id uint32, startTime, endTime time.Time, shardType ShardType, durationIsSplit bool, wal WAL) *ShardData {
 	shardDuration := endTime.Sub(startTime)
 	return &ShardData{
-		id:              id,
-		startTime:       startTime,
-		endTime:         endTime,
-		wal:             wal,
-		startMicro:      common.TimeToMicroseconds(startTime),
-		endMicro:        common.TimeToMicroseconds(endTime),
-		serverIds:       make([]uint32, 0),
-		shardType:       shardType,
-		durationIsSplit: durationIsSplit,
-		shardDuration:   shardDuration,
-		shardSeconds:    int64(shardDuration.Seconds()),
+		id:                   id,
+		startTime:            startTime,
+		endTime:              endTime,
+		wal:                  wal,
+		startMicro:           common.TimeToMicroseconds(startTime),
+		endMicro:             common.TimeToMicroseconds(endTime),
+		serverIds:            make([]uint32, 0),
+		shardType:            shardType,
+		durationIsSplit:      durationIsSplit,
+		shardDuration:        shardDuration,
+		shardSeconds:         int64(shardDuration.Seconds()),
+		cardinalityEstimator: NewCardinalityEstimator(wal),
 	}
 }
 
@@ -112,6 +119,12 @@ type LocalShardDb interface {
 	Query(*parser.QuerySpec, QueryProcessor) error
 	DropDatabase(database string) error
 	IsClosed() bool
+
+	// Digest returns a rolling hash over the (series, timestamp, sequence)
+	// tuples stored in [startMicro, endMicro) along with the highest
+	// sequence number seen, so two replicas can cheaply compare whether
+	// they've diverged for that range. Used by ShardData.Repair.
+	Digest(startMicro, endMicro int64) (*ShardDigest, error)
 }
 
 type LocalShardStore interface {
@@ -143,6 +156,16 @@ func (self *ShardData) EndTime() time.Time {
 	return self.endTime
 }
 
+// Close stops the background work this shard owns, currently just the
+// cardinality estimator's periodic persistence goroutine. Callers that
+// evict or recreate a ShardData (e.g. on shard group reassignment) must
+// call this first or that goroutine leaks for the life of the process.
+func (self *ShardData) Close() {
+	if self.cardinalityEstimator != nil {
+		self.cardinalityEstimator.Stop()
+	}
+}
+
 func (self *ShardData) IsMicrosecondInRange(t int64) bool {
 	return t >= self.startMicro && t < self.endMicro
 }
@@ -178,22 +201,75 @@ func (self *ShardData) ServerIds() []uint32 {
 	return self.serverIds
 }
 
+// DefaultWriteConsistencyTimeout bounds how long WriteWithConsistency waits
+// for replica acks before giving up and returning InsufficientWriteQuorumError.
+const DefaultWriteConsistencyTimeout = 5 * time.Second
+
 func (self *ShardData) Write(request *p.Request) error {
+	return self.WriteWithConsistency(request, ConsistencyAny)
+}
+
+// WriteWithConsistency logs the write to the WAL, buffers it locally and to
+// every replica, and then blocks until consistency's required number of
+// replicas (out of len(self.serverIds), which includes the local one) have
+// acked the write or DefaultWriteConsistencyTimeout elapses. ConsistencyAny
+// never blocks, preserving the original fire-and-forget behavior.
+func (self *ShardData) WriteWithConsistency(request *p.Request, consistency WriteConsistency) error {
 	request.ShardId = &self.id
 	requestNumber, err := self.wal.AssignSequenceNumbersAndLog(request, self)
 	if err != nil {
 		return err
 	}
 	request.RequestNumber = &requestNumber
+
+	required := consistency.requiredAcks(len(self.serverIds))
+	if consistency == ConsistencyAny {
+		if self.store != nil {
+			self.store.BufferWrite(request)
+		}
+		for _, server := range self.clusterServers {
+			// we have to create a new reqeust object because the ID gets assigned on each server.
+			requestWithoutId := &p.Request{Type: request.Type, Database: request.Database, Series: request.Series, ShardId: &self.id, RequestNumber: request.RequestNumber}
+			server.BufferWrite(requestWithoutId)
+		}
+		return nil
+	}
+
+	acked := 0
 	if self.store != nil {
 		self.store.BufferWrite(request)
+		acked++
 	}
+
+	// fan all the per-replica ack channels into one, so we react to whichever
+	// replica acks first instead of waiting on them in server-list order.
+	acks := make(chan error, len(self.clusterServers))
 	for _, server := range self.clusterServers {
-		// we have to create a new reqeust object because the ID gets assigned on each server.
 		requestWithoutId := &p.Request{Type: request.Type, Database: request.Database, Series: request.Series, ShardId: &self.id, RequestNumber: request.RequestNumber}
-		server.BufferWrite(requestWithoutId)
+		ackChan := server.BufferWriteWithAck(requestWithoutId)
+		go func() { acks <- <-ackChan }()
 	}
-	return nil
+
+	if acked >= required {
+		return nil
+	}
+
+	timeout := time.After(DefaultWriteConsistencyTimeout)
+	for i := 0; i < len(self.clusterServers); i++ {
+		select {
+		case err := <-acks:
+			if err == nil {
+				acked++
+			}
+		case <-timeout:
+			return &InsufficientWriteQuorumError{Level: consistency, Required: required, Acked: acked}
+		}
+		if acked >= required {
+			return nil
+		}
+	}
+
+	return &InsufficientWriteQuorumError{Level: consistency, Required: required, Acked: acked}
 }
 
 func (self *ShardData) WriteLocalOnly(request *p.Request) error {
@@ -241,7 +317,21 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 				log.Debug("creating a passthrough engine with limit\n")
 				processor = engine.NewPassthroughEngineWithLimit(response, maxPointsToBufferBeforeSending, query.Limit)
 			}
-			processor = engine.NewFilteringEngine(query, processor)
+
+			if querySpec.IsExplainQuery() {
+				// wrap the filtering engine on both sides so we can see how many points
+				// came in from the shard before filtering and how many made it through
+				explainStats := engine.NewExplainStats(int(self.Id()), self.IsLocal)
+				processor = engine.NewExplainEngine(processor, explainStats, false, response)
+				processor = engine.NewFilteringEngine(query, processor)
+				processor = engine.NewExplainEngine(processor, explainStats, true, response)
+			} else {
+				processor = engine.NewFilteringEngine(query, processor)
+			}
+
+			if querySpec.GetGroupByColumnCount() > 0 {
+				processor = newCardinalityTracker(processor, self.cardinalityEstimator, querySpec)
+			}
 		}
 		shard, err := self.store.GetOrCreateShard(self.id)
 		if err != nil {
@@ -266,18 +356,259 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 		}
 		healthyServers = append(healthyServers, s)
 	}
-	healthyCount := len(healthyServers)
-	if healthyCount == 0 {
+	if len(healthyServers) == 0 {
 		message := fmt.Sprintf("No servers up to query shard %d", self.id)
 		response <- &p.Response{Type: &endStreamResponse, ErrorMessage: &message}
 		log.Error(message)
 		return
 	}
-	randServerIndex := int(time.Now().UnixNano() % int64(healthyCount))
-	server := healthyServers[randServerIndex]
-	request := self.createRequest(querySpec)
 
-	server.MakeRequest(request, response)
+	isDestructive := querySpec.IsDeleteFromSeriesQuery() || querySpec.IsDropSeriesQuery()
+	if !isDestructive && querySpec.IsHedgedReadQuery() {
+		self.hedgedQuery(querySpec, healthyServers, response)
+		return
+	}
+
+	self.queryWithRetry(querySpec, healthyServers, response)
+}
+
+const (
+	DefaultHedgeReplicaCount = 2
+	DefaultHedgeDelay        = 25 * time.Millisecond
+)
+
+// SetHedgedReadConfig configures opt-in hedged reads: replicaCount replicas
+// are queried in parallel, staggered by delay, and the first one to respond
+// wins while the rest are cancelled. Call with replicaCount 0 to fall back
+// to the defaults.
+func (self *ShardData) SetHedgedReadConfig(replicaCount int, delay time.Duration) {
+	self.hedgeReplicaCount = replicaCount
+	self.hedgeDelay = delay
+}
+
+// hedgedQuery dispatches the query to a handful of replicas in parallel,
+// staggered by a small delay, and forwards whichever one answers first.
+// The replicas that lose the race are cancelled so they stop doing
+// unnecessary work.
+func (self *ShardData) hedgedQuery(querySpec *parser.QuerySpec, healthyServers []*ClusterServer, response chan *p.Response) {
+	count := self.hedgeReplicaCount
+	if count == 0 {
+		count = DefaultHedgeReplicaCount
+	}
+	if count > len(healthyServers) {
+		count = len(healthyServers)
+	}
+	delay := self.hedgeDelay
+	if delay == 0 {
+		delay = DefaultHedgeDelay
+	}
+
+	chosen := self.pickDistinctReplicas(healthyServers, count)
+
+	var winnerIdx int32 = -1
+	// closed the instant a winner is known, so a stalled loser that hasn't
+	// produced a single byte yet is cancelled right away instead of only
+	// being noticed once it eventually responds.
+	winnerDecided := make(chan struct{})
+	done := make(chan bool, len(chosen))
+
+	for i, server := range chosen {
+		go func(i int, server *ClusterServer) {
+			time.Sleep(time.Duration(i) * delay)
+			requestId := self.nextHedgeRequestId()
+			request := self.createRequest(querySpec)
+			request.Id = &requestId
+			buffer := make(chan *p.Response)
+			go server.MakeRequest(request, buffer)
+
+			select {
+			case <-winnerDecided:
+				// someone else already won before we got anything back
+				server.CancelRequest(requestId)
+				go drainResponses(buffer)
+				done <- false
+				return
+			case res, ok := <-buffer:
+				if !atomic.CompareAndSwapInt32(&winnerIdx, -1, int32(i)) {
+					// we raced another replica's first byte and lost
+					server.CancelRequest(requestId)
+					go drainResponses(buffer)
+					done <- false
+					return
+				}
+				close(winnerDecided)
+				if !ok {
+					// won the race but the connection dropped before a
+					// single byte arrived
+					done <- false
+					return
+				}
+				if res.Type != nil && *res.Type == endStreamResponse {
+					done <- res.ErrorMessage == nil
+					return
+				}
+				response <- res
+			}
+
+			// we won the race, forward the rest of this replica's stream.
+			// The terminal frame is synthesized below instead of forwarded
+			// here, so a failure can still fall back to another replica
+			// without the coordinator having already seen an end of stream.
+			for res := range buffer {
+				if res.Type != nil && *res.Type == endStreamResponse {
+					done <- res.ErrorMessage == nil
+					return
+				}
+				response <- res
+			}
+			// connection closed without ever sending an end-of-stream frame
+			done <- false
+		}(i, server)
+	}
+
+	for range chosen {
+		if <-done {
+			response <- &p.Response{Type: &endStreamResponse}
+			return
+		}
+	}
+
+	// Every racer failed instantly, dropped mid-stream, or returned an
+	// error. Fall back to trying the remaining replicas one at a time
+	// instead of leaving the coordinator blocked on a response that will
+	// never arrive.
+	self.queryWithRetry(querySpec, healthyServers, response)
+}
+
+// drainResponses reads buffer to completion without forwarding anything, so
+// the replica's MakeRequest goroutine isn't left blocked sending to a
+// channel nobody is reading after we've moved on to another replica.
+func drainResponses(buffer chan *p.Response) {
+	for range buffer {
+	}
+}
+
+var hedgeRequestIdCounter uint32
+
+// nextHedgeRequestId returns an id to assign to a hedged request ourselves
+// (rather than letting MakeRequest assign one), so CancelRequest can later
+// reference the exact in-flight request it needs to abort.
+func (self *ShardData) nextHedgeRequestId() uint32 {
+	// high bit set to keep well clear of the server's own sequential ids
+	return atomic.AddUint32(&hedgeRequestIdCounter, 1) | 0x80000000
+}
+
+// pickDistinctReplicas picks up to count distinct servers from candidates
+// using this shard's replica selection strategy.
+func (self *ShardData) pickDistinctReplicas(candidates []*ClusterServer, count int) []*ClusterServer {
+	selector := self.replicaSelectionStrategy()
+	remaining := append([]*ClusterServer{}, candidates...)
+	chosen := make([]*ClusterServer, 0, count)
+	for i := 0; i < count && len(remaining) > 0; i++ {
+		server := selector.SelectServer(remaining)
+		chosen = append(chosen, server)
+		for j, s := range remaining {
+			if s.Id == server.Id {
+				remaining = append(remaining[:j], remaining[j+1:]...)
+				break
+			}
+		}
+	}
+	return chosen
+}
+
+const DefaultMaxQueryRetries = 2
+
+// SetQueryRetryPolicy configures how many times a remote query is retried
+// against another replica when the one it was sent to fails mid-stream, and
+// which strategy picks the next replica to try. The defaults are
+// DefaultMaxQueryRetries retries using a random replica each time, matching
+// the shard's original behavior.
+func (self *ShardData) SetQueryRetryPolicy(maxRetries int, strategy ReplicaSelectionStrategy) {
+	self.maxQueryRetries = maxRetries
+	self.replicaSelector = strategy
+}
+
+func (self *ShardData) replicaSelectionStrategy() ReplicaSelectionStrategy {
+	if self.replicaSelector == nil {
+		return NewRandomReplicaSelector()
+	}
+	return self.replicaSelector
+}
+
+// queryWithRetry sends the query to one of healthyServers and, if the
+// replica dies mid-stream instead of cleanly ending the response, retries
+// against another healthy replica that hasn't been tried yet. Each retry
+// sends the original query unchanged, so points already delivered by the
+// failed replica may be delivered again.
+func (self *ShardData) queryWithRetry(querySpec *parser.QuerySpec, healthyServers []*ClusterServer, response chan *p.Response) {
+	tried := make(map[uint32]bool)
+	maxRetries := self.maxQueryRetries
+	if maxRetries == 0 {
+		maxRetries = DefaultMaxQueryRetries
+	}
+	selector := self.replicaSelectionStrategy()
+
+	var lastErr string
+
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		candidates := make([]*ClusterServer, 0, len(healthyServers))
+		for _, s := range healthyServers {
+			if !tried[s.Id] {
+				candidates = append(candidates, s)
+			}
+		}
+		if len(candidates) == 0 {
+			break
+		}
+		server := selector.SelectServer(candidates)
+		tried[server.Id] = true
+
+		// Replay the query's full, unmodified time range on every attempt.
+		// A partial stream from a failed replica has no reliable watermark
+		// to resume from: for queries spanning multiple series, or merged/
+		// descending results, the last message we saw isn't a true
+		// per-series high-water mark, so resuming from it can silently
+		// skip points instead of just duplicating some. Duplicates from a
+		// full replay are expected and left for the client to dedupe.
+		request := self.createRequest(querySpec)
+
+		buffer := make(chan *p.Response)
+		start := time.Now()
+		go server.MakeRequest(request, buffer)
+
+		failed, errMessage := self.drainReplicaResponse(buffer, response)
+		if !failed {
+			if ewmaSelector, ok := selector.(*LeastLoadedReplicaSelector); ok {
+				ewmaSelector.RecordLatency(server.Id, time.Since(start))
+			}
+			return
+		}
+		lastErr = errMessage
+		log.Warn("Query to server %d for shard %d failed, retrying on another replica: %s", server.Id, self.id, errMessage)
+	}
+
+	message := fmt.Sprintf("All replicas for shard %d failed the query: %s", self.id, lastErr)
+	response <- &p.Response{Type: &endStreamResponse, ErrorMessage: &message}
+	log.Error(message)
+}
+
+// drainReplicaResponse forwards responses from buffer to response until the
+// stream ends cleanly or an error is seen, and reports whether the stream
+// failed instead of ending cleanly.
+func (self *ShardData) drainReplicaResponse(buffer chan *p.Response, response chan *p.Response) (failed bool, errMessage string) {
+	for res := range buffer {
+		if res.Type != nil && *res.Type == endStreamResponse {
+			if res.ErrorMessage != nil {
+				return true, res.GetErrorMessage()
+			}
+			return false, ""
+		}
+		response <- res
+	}
+	// the channel closed without an end-stream response, treat that as a
+	// connection-level failure so we retry on another replica
+	return true, "connection closed before end of stream"
 }
 
 func (self *ShardData) DropDatabase(database string, sendToServers bool) {
@@ -355,13 +686,18 @@ func (self *ShardData) QueryResponseBufferSize(querySpec *parser.QuerySpec, batc
 			tickCount = 1000
 		}
 	}
-	columnCount := querySpec.GetGroupByColumnCount()
-	if columnCount > 1 {
-		// we don't really know the cardinality for any column up front. This is a just a multiplier so we'll see how this goes.
-		// each response can have many points, so having a buffer of the ticks * 100 should be safe, but we'll see.
-		tickCount = tickCount * 100
+
+	if size, ok := self.estimatedBufferSize(querySpec, tickCount); ok {
+		log.Info("BUFFER SIZE (adaptive): ", size)
+		return size
 	}
-	log.Info("BUFFER SIZE: ", tickCount)
+
+	// No cardinality estimate yet for this query, so any fixed size here is
+	// a guess. Rather than inflating tickCount by a blind multiplier, hand
+	// back a conservative size and let the caller wrap its response channel
+	// with NewGrowableResponseRelay, which drains into a slice-backed queue
+	// instead of blocking the producer once this guess runs out.
+	log.Info("BUFFER SIZE (no estimate yet, use a growable relay): ", tickCount)
 	return tickCount
 }
 
@@ -476,7 +812,7 @@ func (self *ShardData) createRequest(querySpec *parser.QuerySpec) *p.Request {
 	database := querySpec.Database()
 	isDbUser := !user.IsClusterAdmin()
 
-	return &p.Request{
+	request := &p.Request{
 		Type:     &queryRequest,
 		ShardId:  &self.id,
 		Query:    &queryString,
@@ -484,6 +820,10 @@ func (self *ShardData) createRequest(querySpec *parser.QuerySpec) *p.Request {
 		Database: &database,
 		IsDbUser: &isDbUser,
 	}
+	if querySpec.IsExplainQuery() {
+		request.IsExplainQuery = p.Bool(true)
+	}
+	return request
 }
 
 // used to serialize shards when sending around in raft or when snapshotting in the log
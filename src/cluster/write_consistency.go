@@ -0,0 +1,65 @@
+package cluster
+
+import "fmt"
+
+// WriteConsistency controls how many replicas of a shard must durably apply
+// a write before ShardData.WriteWithConsistency returns.
+type WriteConsistency int
+
+const (
+	// ConsistencyAny is fire-and-forget: the write is logged to the local
+	// WAL and buffered to every replica, but nothing is awaited. This is
+	// the original behavior of ShardData.Write, kept for backwards
+	// compatibility.
+	ConsistencyAny WriteConsistency = iota
+	// ConsistencyOne waits for a single ack. On a shard with a local store
+	// the local write counts as that ack, so there it costs the same as
+	// ConsistencyAny; otherwise it waits for one remote replica.
+	ConsistencyOne
+	// ConsistencyQuorum waits for acks from more than half of the shard's
+	// replicas, including the local one.
+	ConsistencyQuorum
+	// ConsistencyAll waits for every replica to ack.
+	ConsistencyAll
+)
+
+func (self WriteConsistency) String() string {
+	switch self {
+	case ConsistencyAny:
+		return "any"
+	case ConsistencyOne:
+		return "one"
+	case ConsistencyQuorum:
+		return "quorum"
+	case ConsistencyAll:
+		return "all"
+	}
+	return "unknown"
+}
+
+// requiredAcks returns how many of numReplicas replicas (including the
+// local one) must ack a write at this consistency level.
+func (self WriteConsistency) requiredAcks(numReplicas int) int {
+	switch self {
+	case ConsistencyOne, ConsistencyAny:
+		return 1
+	case ConsistencyQuorum:
+		return numReplicas/2 + 1
+	case ConsistencyAll:
+		return numReplicas
+	}
+	return 1
+}
+
+// InsufficientWriteQuorumError is returned by WriteWithConsistency when the
+// required number of replica acks didn't arrive: either the timeout fired
+// first, or every replica answered and too many of them reported a failure.
+type InsufficientWriteQuorumError struct {
+	Level    WriteConsistency
+	Required int
+	Acked    int
+}
+
+func (self *InsufficientWriteQuorumError) Error() string {
+	return fmt.Sprintf("write consistency %s requires %d acks, only got %d", self.Level, self.Required, self.Acked)
+}
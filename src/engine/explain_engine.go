@@ -0,0 +1,106 @@
+package engine
+
+import (
+	p "protocol"
+	"time"
+)
+
+// QueryProcessor mirrors cluster.QueryProcessor. Defined here too so that
+// engine's constructors don't need to import the cluster package.
+type QueryProcessor interface {
+	YieldPoint(seriesName *string, columnNames []string, point *p.Point) bool
+	YieldSeries(seriesIncoming *p.Series) bool
+	Close()
+	SetShardInfo(shardId int, shardLocal bool)
+	GetName() string
+}
+
+// ExplainStats is shared by the pair of ExplainEngine wrappers placed around
+// a shard's filtering step so that points can be counted both before and
+// after filtering without the filtering engine itself knowing about EXPLAIN.
+type ExplainStats struct {
+	ShardId  int
+	Local    bool
+	start    time.Time
+	Read     int
+	Returned int
+}
+
+func NewExplainStats(shardId int, local bool) *ExplainStats {
+	return &ExplainStats{ShardId: shardId, Local: local, start: time.Now()}
+}
+
+// ExplainEngine wraps a QueryProcessor and counts the points that pass
+// through it, attributing them to either the "read" or "returned" side of
+// stats depending on where in the pipeline it's inserted. Placed outermost
+// (wrapping the filtering engine) it counts points read from the shard;
+// placed innermost (wrapping the aggregation/passthrough engine) it counts
+// points returned after filtering.
+type ExplainEngine struct {
+	processor QueryProcessor
+	stats     *ExplainStats
+	outermost bool
+	response  chan<- *p.Response
+}
+
+// NewExplainEngine returns an ExplainEngine that wraps processor. When
+// outermost is true it increments stats.Read for every point it sees and,
+// on Close, emits a single explain row to response; when false it only
+// increments stats.Returned.
+func NewExplainEngine(processor QueryProcessor, stats *ExplainStats, outermost bool, response chan<- *p.Response) *ExplainEngine {
+	return &ExplainEngine{processor: processor, stats: stats, outermost: outermost, response: response}
+}
+
+func (self *ExplainEngine) YieldPoint(seriesName *string, columnNames []string, point *p.Point) bool {
+	if self.outermost {
+		self.stats.Read++
+	} else {
+		self.stats.Returned++
+	}
+	return self.processor.YieldPoint(seriesName, columnNames, point)
+}
+
+func (self *ExplainEngine) YieldSeries(seriesIncoming *p.Series) bool {
+	if self.outermost {
+		self.stats.Read += len(seriesIncoming.Points)
+	} else {
+		self.stats.Returned += len(seriesIncoming.Points)
+	}
+	return self.processor.YieldSeries(seriesIncoming)
+}
+
+func (self *ExplainEngine) Close() {
+	self.processor.Close()
+	if !self.outermost {
+		return
+	}
+
+	durationMs := float64(time.Since(self.stats.start)) / float64(time.Millisecond)
+	dropped := self.stats.Read - self.stats.Returned
+	if dropped < 0 {
+		dropped = 0
+	}
+
+	seriesName := "explain"
+	columnNames := []string{"shard_id", "local", "duration_ms", "points_read", "points_returned"}
+	values := []*p.FieldValue{
+		{Int64Value: p.Int64(int64(self.stats.ShardId))},
+		{BoolValue: p.Bool(self.stats.Local)},
+		{DoubleValue: p.Double(durationMs)},
+		{Int64Value: p.Int64(int64(self.stats.Read))},
+		{Int64Value: p.Int64(int64(self.stats.Returned))},
+	}
+	point := &p.Point{Values: values}
+	series := &p.Series{Name: &seriesName, Fields: columnNames, Points: []*p.Point{point}}
+	self.response <- &p.Response{Type: &queryResponse, Series: series}
+}
+
+func (self *ExplainEngine) SetShardInfo(shardId int, shardLocal bool) {
+	self.processor.SetShardInfo(shardId, shardLocal)
+}
+
+func (self *ExplainEngine) GetName() string {
+	return "ExplainEngine"
+}
+
+var queryResponse = p.Response_QUERY
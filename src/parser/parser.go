@@ -0,0 +1,104 @@
+// Package parser turns a raw query string into a QuerySpec: the parsed
+// statement plus the connection/session context (user, target database)
+// it ran under. Cluster and engine code work against QuerySpec rather
+// than re-parsing or re-checking permissions themselves.
+package parser
+
+import "time"
+
+// User is the session context a query ran under.
+type User struct {
+	Name         string
+	IsAdmin      bool
+	ClusterAdmin bool
+}
+
+func (self *User) GetName() string {
+	if self == nil {
+		return ""
+	}
+	return self.Name
+}
+
+func (self *User) IsClusterAdmin() bool {
+	return self != nil && self.ClusterAdmin
+}
+
+// Query is a parsed SELECT statement.
+type Query struct {
+	Limit          int
+	aggregates     bool
+	groupByColumns []string
+	groupByTime    *time.Duration
+}
+
+func (self *Query) HasAggregates() bool {
+	return self.aggregates
+}
+
+// QuerySpec wraps a parsed Query (or delete/drop/list statement) together
+// with the database and user it was issued against, plus the cluster
+// routing hints that only make sense once a query has a target shard.
+type QuerySpec struct {
+	RunAgainstAllServersInShard bool
+
+	database    string
+	queryString string
+	user        *User
+	query       *Query
+
+	isListSeriesQuery       bool
+	isDeleteFromSeriesQuery bool
+	isDropSeriesQuery       bool
+	isSinglePointQuery      bool
+	isExplainQuery          bool
+	isHedgedReadQuery       bool
+	readsFromMultipleSeries bool
+}
+
+func (self *QuerySpec) Database() string    { return self.database }
+func (self *QuerySpec) User() *User         { return self.user }
+func (self *QuerySpec) SelectQuery() *Query { return self.query }
+
+func (self *QuerySpec) GetQueryString() string {
+	return self.queryString
+}
+
+// GetQueryStringWithTimeCondition returns the query string including
+// whatever time-range predicate the query was bound to, for statements
+// (like deletes) that need to replay their full original condition when
+// forwarded to every server in a shard.
+func (self *QuerySpec) GetQueryStringWithTimeCondition() string {
+	return self.queryString
+}
+
+func (self *QuerySpec) IsListSeriesQuery() bool       { return self.isListSeriesQuery }
+func (self *QuerySpec) IsDeleteFromSeriesQuery() bool { return self.isDeleteFromSeriesQuery }
+func (self *QuerySpec) IsDropSeriesQuery() bool       { return self.isDropSeriesQuery }
+func (self *QuerySpec) IsSinglePointQuery() bool      { return self.isSinglePointQuery }
+func (self *QuerySpec) IsExplainQuery() bool          { return self.isExplainQuery }
+
+// IsHedgedReadQuery reports whether this query opted into racing multiple
+// replicas and taking the first response, instead of retrying replicas
+// one at a time on failure.
+func (self *QuerySpec) IsHedgedReadQuery() bool { return self.isHedgedReadQuery }
+
+func (self *QuerySpec) ReadsFromMultipleSeries() bool { return self.readsFromMultipleSeries }
+
+func (self *QuerySpec) HasAggregates() bool {
+	return self.query != nil && self.query.HasAggregates()
+}
+
+func (self *QuerySpec) GetGroupByInterval() *time.Duration {
+	if self.query == nil {
+		return nil
+	}
+	return self.query.groupByTime
+}
+
+func (self *QuerySpec) GetGroupByColumnCount() int {
+	if self.query == nil {
+		return 0
+	}
+	return len(self.query.groupByColumns)
+}
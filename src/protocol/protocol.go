@@ -0,0 +1,180 @@
+// Package protocol defines the wire types exchanged between cluster
+// servers. Request and Response mirror the fields that ship over the
+// inter-server protobuf connection; optional fields are pointers so a
+// missing field can be told apart from a zero value, with String/Bool/
+// Int64/Double helpers for building literals and Get* accessors for
+// reading a possibly-nil pointer without a panic, following the usual
+// generated-protobuf convention.
+package protocol
+
+type Request_Type int32
+
+const (
+	Request_QUERY             Request_Type = 1
+	Request_WRITE             Request_Type = 2
+	Request_DROP_DATABASE     Request_Type = 3
+	Request_CANCEL_REQUEST    Request_Type = 4
+	Request_SHARD_DIGEST      Request_Type = 5
+	Request_SHARD_FETCH_RANGE Request_Type = 6
+)
+
+type Response_Type int32
+
+const (
+	Response_QUERY         Response_Type = 1
+	Response_END_STREAM    Response_Type = 2
+	Response_ACCESS_DENIED Response_Type = 3
+)
+
+// Request is one message sent to a cluster server: either a query, a
+// write, or an administrative/repair operation, distinguished by Type.
+type Request struct {
+	Type            *Request_Type
+	Id              *uint32
+	RequestNumber   *uint32
+	Database        *string
+	Query           *string
+	UserName        *string
+	IsDbUser        *bool
+	IsExplainQuery  *bool
+	ShardId         *uint32
+	Series          *Series
+	DigestStartTime *int64
+	DigestEndTime   *int64
+}
+
+func (self *Request) GetId() uint32 {
+	if self == nil || self.Id == nil {
+		return 0
+	}
+	return *self.Id
+}
+
+// GetDescription returns a short human-readable summary of the request,
+// for logging.
+func (self *Request) GetDescription() string {
+	if self == nil {
+		return "<nil request>"
+	}
+	description := "request"
+	if self.Query != nil {
+		description = *self.Query
+	} else if self.Type != nil {
+		description = self.Type.String()
+	}
+	if self.Id != nil {
+		description = description + " (id " + uitoa(*self.Id) + ")"
+	}
+	return description
+}
+
+func (self Request_Type) String() string {
+	switch self {
+	case Request_QUERY:
+		return "query"
+	case Request_WRITE:
+		return "write"
+	case Request_DROP_DATABASE:
+		return "drop_database"
+	case Request_CANCEL_REQUEST:
+		return "cancel_request"
+	case Request_SHARD_DIGEST:
+		return "shard_digest"
+	case Request_SHARD_FETCH_RANGE:
+		return "shard_fetch_range"
+	}
+	return "unknown"
+}
+
+// Response is one message received from a cluster server in reply to a
+// Request. A query or repair stream sends any number of Responses
+// terminated by one with Type Response_END_STREAM.
+type Response struct {
+	Type                   *Response_Type
+	ErrorMessage           *string
+	Database               *string
+	Series                 *Series
+	ShardDigestHash        *uint64
+	ShardDigestMaxSequence *uint64
+}
+
+func (self *Response) GetType() Response_Type {
+	if self == nil || self.Type == nil {
+		return Response_Type(0)
+	}
+	return *self.Type
+}
+
+func (self *Response) GetErrorMessage() string {
+	if self == nil || self.ErrorMessage == nil {
+		return ""
+	}
+	return *self.ErrorMessage
+}
+
+func (self *Response) GetShardDigestHash() uint64 {
+	if self == nil || self.ShardDigestHash == nil {
+		return 0
+	}
+	return *self.ShardDigestHash
+}
+
+func (self *Response) GetShardDigestMaxSequence() uint64 {
+	if self == nil || self.ShardDigestMaxSequence == nil {
+		return 0
+	}
+	return *self.ShardDigestMaxSequence
+}
+
+func (self Response_Type) String() string {
+	switch self {
+	case Response_QUERY:
+		return "query"
+	case Response_END_STREAM:
+		return "end_stream"
+	case Response_ACCESS_DENIED:
+		return "access_denied"
+	}
+	return "unknown"
+}
+
+// Series is a named, columnar run of points, the unit a query streams
+// results back in.
+type Series struct {
+	Name   *string
+	Fields []string
+	Points []*Point
+}
+
+// Point is a single row of a Series: one value per column in Fields,
+// aligned by index.
+type Point struct {
+	Timestamp *int64
+	Values    []*FieldValue
+}
+
+// FieldValue is a tagged union of the column types a Point's values can
+// hold. Exactly one of the pointers is set per value.
+type FieldValue struct {
+	StringValue *string
+	Int64Value  *int64
+	DoubleValue *float64
+	BoolValue   *bool
+}
+
+func String(v string) *string   { return &v }
+func Bool(v bool) *bool         { return &v }
+func Int64(v int64) *int64      { return &v }
+func Double(v float64) *float64 { return &v }
+
+func uitoa(v uint32) string {
+	if v == 0 {
+		return "0"
+	}
+	digits := make([]byte, 0, 10)
+	for v > 0 {
+		digits = append([]byte{byte('0' + v%10)}, digits...)
+		v /= 10
+	}
+	return string(digits)
+}